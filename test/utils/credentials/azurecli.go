@@ -0,0 +1,56 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import "encoding/json"
+
+// azureCLISubscription is the subset of `az login`'s azureProfile.json that
+// identifies the active subscription and its tenant.
+type azureCLISubscription struct {
+	ID        string `json:"id"`
+	TenantID  string `json:"tenantId"`
+	IsDefault bool   `json:"isDefault"`
+}
+
+type azureCLIProfile struct {
+	Subscriptions []azureCLISubscription `json:"subscriptions"`
+}
+
+// cliProfile is the tenant/subscription pair to use for an Azure CLI-based
+// run, resolved from azureProfile.json's default subscription.
+type cliProfile struct {
+	TenantID       string
+	SubscriptionID string
+}
+
+// parseAzureCLIProfile extracts the default subscription's tenant and
+// subscription ID from an azureProfile.json document. It returns nil, nil if
+// no subscription is marked as default.
+func parseAzureCLIProfile(content []byte) (*cliProfile, error) {
+	profile := azureCLIProfile{}
+	if err := json.Unmarshal(content, &profile); err != nil {
+		return nil, err
+	}
+
+	for _, sub := range profile.Subscriptions {
+		if sub.IsDefault {
+			return &cliProfile{TenantID: sub.TenantID, SubscriptionID: sub.ID}, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -17,11 +17,16 @@ limitations under the License.
 package credentials
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"sigs.k8s.io/azurefile-csi-driver/test/utils/testutil"
 
@@ -30,8 +35,6 @@ import (
 )
 
 const (
-	AzurePublicCloud            = "AzurePublicCloud"
-	AzureChinaCloud             = "AzureChinaCloud"
 	ResourceGroupPrefix         = "azurefile-csi-driver-test-"
 	TempAzureCredentialFilePath = "/tmp/azure.json"
 
@@ -41,14 +44,20 @@ const (
     "subscriptionId": "{{.SubscriptionID}}",
     "aadClientId": "{{.AADClientID}}",
     "aadClientSecret": "{{.AADClientSecret}}",
+    "aadClientCertPath": "{{.AADClientCertPath}}",
+    "aadClientCertPassword": "{{.AADClientCertPassword}}",
     "resourceGroup": "{{.ResourceGroup}}",
 	"location": "{{.Location}}",
+	"storageAccountName": "{{.StorageAccountName}}",
+	"storageAccountKey": "{{.StorageAccountKey}}",
+	"useManagedIdentityExtension": {{.UseManagedIdentityExtension}},
+	"userAssignedIdentityID": "{{.UserAssignedIdentityID}}",
+	"aadFederatedTokenFile": "{{.AADFederatedTokenFile}}",
+	"aadAuthorityHost": "{{.AADAuthorityHost}}",
 	"cloudProviderBackoff": {{.CloudProviderBackoff}},
 	"cloudProviderBackoffRetries": {{.CloudProviderBackoffRetries}},
     "cloudProviderBackoffDuration": {{.CloudProviderBackoffDuration}}
 }`
-	defaultAzurePublicCloudLocation     = "eastus2"
-	defaultAzureChinaCloudLocation      = "chinaeast2"
 	defaultCloudProviderBackoff         = true
 	defaultCloudProviderBackoffRetries  = 6
 	defaultCloudProviderBackoffDuration = 5
@@ -67,6 +76,35 @@ const (
 	aadClientSecretChinaEnvVar = "AAD_CLIENT_SECRET_CHINA"
 	resourceGroupChinaEnvVar   = "RESOURCE_GROUP_CHINA"
 	locationChinaEnvVar        = "LOCATION_CHINA"
+
+	// azureCredentialsFileEnvVar points at a standalone TOML or JSON
+	// credential file, as an alternative to setting the env vars above.
+	azureCredentialsFileEnvVar = "AZURE_CREDENTIALS_FILE"
+
+	// azureCLIProfilePath and azureCLIAccessTokensPath are where `az login`
+	// caches the active subscription/tenant and access tokens.
+	azureCLIProfilePath      = ".azure/azureProfile.json"
+	azureCLIAccessTokensPath = ".azure/accessTokens.json"
+
+	// credentialFileMode restricts the generated credential file to the
+	// owner, since it may contain a service principal secret.
+	credentialFileMode = 0600
+
+	// useManagedIdentityExtensionEnvVar and userAssignedIdentityIDEnvVar
+	// select managed identity auth, mirroring cloud-provider-azure's Config.
+	useManagedIdentityExtensionEnvVar = "USE_MANAGED_IDENTITY_EXTENSION"
+	userAssignedIdentityIDEnvVar      = "USER_ASSIGNED_IDENTITY_ID"
+
+	// Workload identity env vars, populated by the Azure Workload Identity
+	// mutating webhook. See https://azure.github.io/azure-workload-identity.
+	azureClientIDEnvVar           = "AZURE_CLIENT_ID"
+	azureTenantIDEnvVar           = "AZURE_TENANT_ID"
+	azureFederatedTokenFileEnvVar = "AZURE_FEDERATED_TOKEN_FILE"
+	azureAuthorityHostEnvVar      = "AZURE_AUTHORITY_HOST"
+
+	// Client certificate env vars, used instead of AAD_CLIENT_SECRET.
+	aadClientCertPathEnvVar     = "AAD_CLIENT_CERT_PATH"
+	aadClientCertPasswordEnvVar = "AAD_CLIENT_CERT_PASSWORD"
 )
 
 // Config is used in Prow to store Azure credentials
@@ -88,72 +126,282 @@ type FromProw struct {
 
 // Credentials is used in Azure File CSI Driver to store Azure credentials
 type Credentials struct {
-	Cloud                        string
-	TenantID                     string
-	SubscriptionID               string
-	AADClientID                  string
-	AADClientSecret              string
-	ResourceGroup                string
-	Location                     string
+	Cloud           string
+	TenantID        string
+	SubscriptionID  string
+	AADClientID     string
+	AADClientSecret string
+	ResourceGroup   string
+	Location        string
+
+	StorageAccountName string
+	StorageAccountKey  string
+
+	// AADClientCertPath and AADClientCertPassword authenticate with an AAD
+	// client certificate instead of AADClientSecret.
+	AADClientCertPath     string
+	AADClientCertPassword string
+
+	// UseManagedIdentityExtension and UserAssignedIdentityID select
+	// managed identity auth; UserAssignedIdentityID is empty for a
+	// system-assigned identity.
+	UseManagedIdentityExtension bool
+	UserAssignedIdentityID      string
+
+	// AADFederatedTokenFile and AADAuthorityHost select workload identity
+	// auth, populated from the environment by credentialsFromWorkloadIdentity.
+	AADFederatedTokenFile string
+	AADAuthorityHost      string
+
 	CloudProviderBackoff         bool
 	CloudProviderBackoffRetries  int
 	CloudProviderBackoffDuration int
 }
 
-// CreateAzureCredentialFile creates a temporary Azure credential file for
-// Azure File CSI driver tests and returns the credentials
-func CreateAzureCredentialFile(isAzureChinaCloud bool) (*Credentials, error) {
-	// Search credentials through env vars first
-	var cloud, tenantID, subscriptionID, aadClientID, aadClientSecret, resourceGroup, location string
-	if isAzureChinaCloud {
-		cloud = AzureChinaCloud
-		tenantID = os.Getenv(tenantIDChinaEnvVar)
-		subscriptionID = os.Getenv(subscriptionIDChinaEnvVar)
-		aadClientID = os.Getenv(aadClientIDChinaEnvVar)
-		aadClientSecret = os.Getenv(aadClientSecretChinaEnvVar)
-		resourceGroup = os.Getenv(resourceGroupChinaEnvVar)
-		location = os.Getenv(locationChinaEnvVar)
-	} else {
-		cloud = AzurePublicCloud
+// resolver produces credentials for one source. It returns nil, nil when the
+// source has nothing to offer, so resolveCredentials can fall through to the
+// next one in the chain.
+type resolver func(env cloudEnvironment) (*Credentials, error)
+
+// resolvers are tried in order, mirroring azidentity's
+// ChainedTokenCredential: managed identity, workload identity, a client
+// certificate, env vars, an AZURE_CREDENTIALS_FILE, the Azure CLI token
+// cache, and finally Prow's AZURE_CREDENTIALS.
+var resolvers = []resolver{
+	credentialsFromManagedIdentity,
+	credentialsFromWorkloadIdentity,
+	credentialsFromClientCertificate,
+	credentialsFromEnv,
+	credentialsFromFile,
+	credentialsFromAzureCLI,
+	credentialsFromProw,
+}
+
+// resolveCredentials runs the resolver chain for isAzureChinaCloud, fetches
+// aadClientSecret from Key Vault if configured, and fills in the
+// cloud-provider backoff defaults. It is the one-shot resolution a
+// CredentialProvider caches.
+func resolveCredentials(ctx context.Context, isAzureChinaCloud bool) (*Credentials, error) {
+	env := resolveCloudEnvironment(isAzureChinaCloud)
+
+	for _, resolve := range resolvers {
+		creds, err := resolve(env)
+		if err != nil {
+			return nil, err
+		}
+		if creds == nil {
+			continue
+		}
+
+		if err := resolveAADClientSecretFromKeyVault(ctx, creds); err != nil {
+			return nil, err
+		}
+
+		creds.CloudProviderBackoff = defaultCloudProviderBackoff
+		creds.CloudProviderBackoffRetries = defaultCloudProviderBackoffRetries
+		creds.CloudProviderBackoffDuration = defaultCloudProviderBackoffDuration
+		return creds, nil
+	}
+
+	return nil, fmt.Errorf("no Azure credentials found: set $%s, $%s, $%s, $%s, $%s, $%s, or $%s",
+		tenantIDEnvVar, subscriptionIDEnvVar, aadClientIDEnvVar, aadClientSecretEnvVar, resourceGroupEnvVar, locationEnvVar, azureCredentialsFileEnvVar)
+}
+
+// credentialsFromManagedIdentity builds credentials for a system- or
+// user-assigned managed identity, selected by USE_MANAGED_IDENTITY_EXTENSION.
+// It needs no AAD client ID or secret, and is tried first.
+func credentialsFromManagedIdentity(env cloudEnvironment) (*Credentials, error) {
+	if os.Getenv(useManagedIdentityExtensionEnvVar) != "true" {
+		return nil, nil
+	}
+
+	return &Credentials{
+		Cloud:                       env.name,
+		TenantID:                    os.Getenv(tenantIDEnvVar),
+		SubscriptionID:              os.Getenv(subscriptionIDEnvVar),
+		ResourceGroup:               resourceGroupOrDefault(os.Getenv(resourceGroupEnvVar)),
+		Location:                    locationOrDefault(os.Getenv(locationEnvVar), env),
+		UseManagedIdentityExtension: true,
+		UserAssignedIdentityID:      os.Getenv(userAssignedIdentityIDEnvVar),
+	}, nil
+}
+
+// credentialsFromWorkloadIdentity builds credentials for a federated
+// workload identity token, as injected by the Azure Workload Identity
+// mutating webhook.
+func credentialsFromWorkloadIdentity(env cloudEnvironment) (*Credentials, error) {
+	federatedTokenFile := os.Getenv(azureFederatedTokenFileEnvVar)
+	if federatedTokenFile == "" {
+		return nil, nil
+	}
+
+	tenantID := os.Getenv(azureTenantIDEnvVar)
+	if tenantID == "" {
 		tenantID = os.Getenv(tenantIDEnvVar)
-		subscriptionID = os.Getenv(subscriptionIDEnvVar)
-		aadClientID = os.Getenv(aadClientIDEnvVar)
-		aadClientSecret = os.Getenv(aadClientSecretEnvVar)
-		resourceGroup = os.Getenv(resourceGroupEnvVar)
-		location = os.Getenv(locationEnvVar)
 	}
 
-	if resourceGroup == "" {
-		resourceGroup = ResourceGroupPrefix + uuid.NewUUID().String()
+	return &Credentials{
+		Cloud:                 env.name,
+		TenantID:              tenantID,
+		SubscriptionID:        os.Getenv(subscriptionIDEnvVar),
+		AADClientID:           os.Getenv(azureClientIDEnvVar),
+		ResourceGroup:         resourceGroupOrDefault(os.Getenv(resourceGroupEnvVar)),
+		Location:              locationOrDefault(os.Getenv(locationEnvVar), env),
+		AADFederatedTokenFile: federatedTokenFile,
+		AADAuthorityHost:      os.Getenv(azureAuthorityHostEnvVar),
+	}, nil
+}
+
+// credentialsFromClientCertificate builds credentials for an AAD client
+// certificate, selected by AAD_CLIENT_CERT_PATH.
+func credentialsFromClientCertificate(env cloudEnvironment) (*Credentials, error) {
+	certPath := os.Getenv(aadClientCertPathEnvVar)
+	if certPath == "" {
+		return nil, nil
 	}
 
-	if location == "" {
-		if isAzureChinaCloud {
-			location = defaultAzureChinaCloudLocation
-		} else {
-			location = defaultAzurePublicCloudLocation
+	return &Credentials{
+		Cloud:                 env.name,
+		TenantID:              os.Getenv(tenantIDEnvVar),
+		SubscriptionID:        os.Getenv(subscriptionIDEnvVar),
+		AADClientID:           os.Getenv(aadClientIDEnvVar),
+		ResourceGroup:         resourceGroupOrDefault(os.Getenv(resourceGroupEnvVar)),
+		Location:              locationOrDefault(os.Getenv(locationEnvVar), env),
+		AADClientCertPath:     certPath,
+		AADClientCertPassword: os.Getenv(aadClientCertPasswordEnvVar),
+	}, nil
+}
+
+// credentialsFromEnv builds credentials from the env vars a developer would
+// set when running tests locally.
+func credentialsFromEnv(env cloudEnvironment) (*Credentials, error) {
+	tenantIDVar, subscriptionIDVar, aadClientIDVar, aadClientSecretVar, resourceGroupVar, locationVar := tenantIDEnvVar, subscriptionIDEnvVar, aadClientIDEnvVar, aadClientSecretEnvVar, resourceGroupEnvVar, locationEnvVar
+	if env.name == AzureChinaCloud {
+		tenantIDVar, subscriptionIDVar, aadClientIDVar, aadClientSecretVar, resourceGroupVar, locationVar = tenantIDChinaEnvVar, subscriptionIDChinaEnvVar, aadClientIDChinaEnvVar, aadClientSecretChinaEnvVar, resourceGroupChinaEnvVar, locationChinaEnvVar
+	}
+
+	tenantID, subscriptionID, aadClientID, aadClientSecret := os.Getenv(tenantIDVar), os.Getenv(subscriptionIDVar), os.Getenv(aadClientIDVar), os.Getenv(aadClientSecretVar)
+	if tenantID == "" || subscriptionID == "" || aadClientID == "" || aadClientSecret == "" {
+		return nil, nil
+	}
+
+	return &Credentials{
+		Cloud:           env.name,
+		TenantID:        tenantID,
+		SubscriptionID:  subscriptionID,
+		AADClientID:     aadClientID,
+		AADClientSecret: aadClientSecret,
+		ResourceGroup:   resourceGroupOrDefault(os.Getenv(resourceGroupVar)),
+		Location:        locationOrDefault(os.Getenv(locationVar), env),
+	}, nil
+}
+
+// credentialsFromFile reads AZURE_CREDENTIALS_FILE, accepting either TOML or
+// JSON encoding of the same schema as the Prow credentials file. The format
+// is chosen by file extension (".json" is JSON, anything else is TOML).
+func credentialsFromFile(env cloudEnvironment) (*Credentials, error) {
+	path := os.Getenv(azureCredentialsFileEnvVar)
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s %v", path, err)
+	}
+
+	c := Config{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(content, &c); err != nil {
+			return nil, fmt.Errorf("error parsing %s %v", path, err)
 		}
+	} else if err := toml.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s %v", path, err)
+	}
+
+	return &Credentials{
+		Cloud:           env.name,
+		TenantID:        c.Creds.TenantID,
+		SubscriptionID:  c.Creds.SubscriptionID,
+		AADClientID:     c.Creds.ClientID,
+		AADClientSecret: c.Creds.ClientSecret,
+		ResourceGroup:   resourceGroupOrDefault(""),
+		Location:        locationOrDefault("", env),
+	}, nil
+}
+
+// credentialsFromAzureCLI resolves the tenant and subscription that `az
+// login` left active in ~/.azure, for use alongside an AAD app registration
+// supplied through AAD_CLIENT_ID/AAD_CLIENT_SECRET.
+func credentialsFromAzureCLI(env cloudEnvironment) (*Credentials, error) {
+	aadClientID, aadClientSecret := os.Getenv(aadClientIDEnvVar), os.Getenv(aadClientSecretEnvVar)
+	if aadClientID == "" || aadClientSecret == "" {
+		return nil, nil
 	}
 
-	// Running test locally
-	if tenantID != "" && subscriptionID != "" && aadClientID != "" && aadClientSecret != "" {
-		return parseAndExecuteTemplate(cloud, tenantID, subscriptionID, aadClientID, aadClientSecret, resourceGroup, location)
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil
 	}
 
-	// If the tests are being run in Prow, credentials are not supplied through env vars. Instead, it is supplied
-	// through env var AZURE_CREDENTIALS. We need to convert it to AZURE_CREDENTIAL_FILE for sanity, integration and E2E tests
-	// https://github.com/kubernetes/test-infra/blob/master/config/jobs/kubernetes/cloud-provider-azure/cloud-provider-azure-config.yaml#L5-L6
-	if testutil.IsRunningInProw() {
-		log.Println("Running in Prow, converting AZURE_CREDENTIALS to AZURE_CREDENTIAL_FILE")
-		c, err := getCredentialsFromAzureCredentials(os.Getenv("AZURE_CREDENTIALS"))
-		if err != nil {
-			return nil, err
+	if _, err := os.Stat(filepath.Join(homeDir, azureCLIAccessTokensPath)); err != nil {
+		return nil, nil
+	}
+
+	profilePath := filepath.Join(homeDir, azureCLIProfilePath)
+	content, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-		return parseAndExecuteTemplate(cloud, c.TenantID, c.SubscriptionID, c.ClientID, c.ClientSecret, resourceGroup, location)
+		return nil, fmt.Errorf("error reading %s %v", profilePath, err)
+	}
+
+	profile, err := parseAzureCLIProfile(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s %v", profilePath, err)
 	}
 
-	return nil, fmt.Errorf("If you are running tests locally, you will need to set the following env vars: $%s, $%s, $%s, $%s, $%s, $%s",
-		tenantIDEnvVar, subscriptionIDEnvVar, aadClientIDEnvVar, aadClientSecretEnvVar, resourceGroupEnvVar, locationEnvVar)
+	if profile == nil {
+		return nil, nil
+	}
+
+	return &Credentials{
+		Cloud:           env.name,
+		TenantID:        profile.TenantID,
+		SubscriptionID:  profile.SubscriptionID,
+		AADClientID:     aadClientID,
+		AADClientSecret: aadClientSecret,
+		ResourceGroup:   resourceGroupOrDefault(os.Getenv(resourceGroupEnvVar)),
+		Location:        locationOrDefault(os.Getenv(locationEnvVar), env),
+	}, nil
+}
+
+// credentialsFromProw converts Prow's AZURE_CREDENTIALS env var, used when
+// the tests are running as a Prow job rather than locally.
+// https://github.com/kubernetes/test-infra/blob/master/config/jobs/kubernetes/cloud-provider-azure/cloud-provider-azure-config.yaml#L5-L6
+func credentialsFromProw(env cloudEnvironment) (*Credentials, error) {
+	if !testutil.IsRunningInProw() {
+		return nil, nil
+	}
+
+	log.Println("Running in Prow, converting AZURE_CREDENTIALS to AZURE_CREDENTIAL_FILE")
+	c, err := getCredentialsFromAzureCredentials(os.Getenv("AZURE_CREDENTIALS"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{
+		Cloud:              env.name,
+		TenantID:           c.TenantID,
+		SubscriptionID:     c.SubscriptionID,
+		AADClientID:        c.ClientID,
+		AADClientSecret:    c.ClientSecret,
+		ResourceGroup:      resourceGroupOrDefault(""),
+		Location:           locationOrDefault("", env),
+		StorageAccountName: c.StorageAccountName,
+		StorageAccountKey:  c.StorageAccountKey,
+	}, nil
 }
 
 // DeleteAzureCredentialFile deletes the temporary Azure credential file
@@ -182,36 +430,39 @@ func getCredentialsFromAzureCredentials(azureCredentialsPath string) (*FromProw,
 	return &c.Creds, nil
 }
 
-// parseAndExecuteTemplate replaces credential placeholders in azureCredentialFileTemplate with actual credentials
-func parseAndExecuteTemplate(cloud, tenantID, subscriptionID, aadClientID, aadClientSecret, resourceGroup, location string) (*Credentials, error) {
-	t := template.New("AzureCredentialFileTemplate")
-	t, err := t.Parse(azureCredentialFileTemplate)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing azureCredentialFileTemplate %v", err)
+// resourceGroupOrDefault returns resourceGroup, or a freshly generated,
+// uniquely named resource group if it is empty.
+func resourceGroupOrDefault(resourceGroup string) string {
+	if resourceGroup == "" {
+		return ResourceGroupPrefix + uuid.NewUUID().String()
 	}
+	return resourceGroup
+}
 
-	f, err := os.Create(TempAzureCredentialFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("error creating %s %v", TempAzureCredentialFilePath, err)
-	}
-	defer f.Close()
-
-	c := Credentials{
-		cloud,
-		tenantID,
-		subscriptionID,
-		aadClientID,
-		aadClientSecret,
-		resourceGroup,
-		location,
-		defaultCloudProviderBackoff,
-		defaultCloudProviderBackoffRetries,
-		defaultCloudProviderBackoffDuration,
-	}
-	err = t.Execute(f, c)
+// locationOrDefault returns location, or env's default location if it is empty.
+func locationOrDefault(location string, env cloudEnvironment) string {
+	if location == "" {
+		return env.defaultLocation
+	}
+	return location
+}
+
+// writeCredentialFile replaces credential placeholders in
+// azureCredentialFileTemplate with creds and writes the result to path.
+func writeCredentialFile(path string, creds *Credentials) error {
+	t, err := template.New("AzureCredentialFileTemplate").Parse(azureCredentialFileTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("error executing parsed azure credential file template %v", err)
+		return fmt.Errorf("error parsing azureCredentialFileTemplate %v", err)
 	}
 
-	return &c, nil
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, creds); err != nil {
+		return fmt.Errorf("error executing parsed azure credential file template %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), credentialFileMode); err != nil {
+		return fmt.Errorf("error creating %s %v", path, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,196 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clearCredentialEnvVars(t *testing.T) {
+	for _, v := range []string{
+		tenantIDEnvVar, subscriptionIDEnvVar, aadClientIDEnvVar, aadClientSecretEnvVar, resourceGroupEnvVar, locationEnvVar,
+		tenantIDChinaEnvVar, subscriptionIDChinaEnvVar, aadClientIDChinaEnvVar, aadClientSecretChinaEnvVar, resourceGroupChinaEnvVar, locationChinaEnvVar,
+		azureCredentialsFileEnvVar, azureEnvironmentFilepathEnvVar, azureEnvironmentEnvVar, aadClientSecretKeyVaultURLEnvVar,
+		useManagedIdentityExtensionEnvVar, userAssignedIdentityIDEnvVar,
+		azureClientIDEnvVar, azureTenantIDEnvVar, azureFederatedTokenFileEnvVar, azureAuthorityHostEnvVar,
+		aadClientCertPathEnvVar, aadClientCertPasswordEnvVar,
+	} {
+		t.Setenv(v, "")
+	}
+}
+
+func TestCredentialsFromEnv(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(tenantIDEnvVar, "tenant")
+	t.Setenv(subscriptionIDEnvVar, "sub")
+	t.Setenv(aadClientIDEnvVar, "client")
+	t.Setenv(aadClientSecretEnvVar, "secret")
+
+	creds, err := credentialsFromEnv(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.Equal(t, "tenant", creds.TenantID)
+	assert.Equal(t, AzurePublicCloud, creds.Cloud)
+}
+
+func TestCredentialsFromEnvMissing(t *testing.T) {
+	clearCredentialEnvVars(t)
+
+	creds, err := credentialsFromEnv(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.Nil(t, creds)
+}
+
+func TestCredentialsFromManagedIdentity(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(useManagedIdentityExtensionEnvVar, "true")
+	t.Setenv(userAssignedIdentityIDEnvVar, "identity-id")
+
+	creds, err := credentialsFromManagedIdentity(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.True(t, creds.UseManagedIdentityExtension)
+	assert.Equal(t, "identity-id", creds.UserAssignedIdentityID)
+}
+
+func TestCredentialsFromManagedIdentityDisabled(t *testing.T) {
+	clearCredentialEnvVars(t)
+
+	creds, err := credentialsFromManagedIdentity(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.Nil(t, creds)
+}
+
+func TestCredentialsFromWorkloadIdentity(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(azureClientIDEnvVar, "client-id")
+	t.Setenv(azureTenantIDEnvVar, "tenant-id")
+	t.Setenv(azureFederatedTokenFileEnvVar, "/var/run/secrets/tokens/azure-identity-token")
+	t.Setenv(azureAuthorityHostEnvVar, "https://login.microsoftonline.com/")
+
+	creds, err := credentialsFromWorkloadIdentity(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.Equal(t, "client-id", creds.AADClientID)
+	assert.Equal(t, "tenant-id", creds.TenantID)
+	assert.Equal(t, "/var/run/secrets/tokens/azure-identity-token", creds.AADFederatedTokenFile)
+}
+
+func TestCredentialsFromClientCertificate(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(aadClientIDEnvVar, "client-id")
+	t.Setenv(aadClientCertPathEnvVar, "/var/run/secrets/aad/cert.pem")
+	t.Setenv(aadClientCertPasswordEnvVar, "cert-password")
+
+	creds, err := credentialsFromClientCertificate(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.Equal(t, "/var/run/secrets/aad/cert.pem", creds.AADClientCertPath)
+	assert.Equal(t, "cert-password", creds.AADClientCertPassword)
+}
+
+func TestCredentialsFromFile(t *testing.T) {
+	clearCredentialEnvVars(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.toml")
+	content := `[Creds]
+	ClientID = "client"
+	ClientSecret = "secret"
+	TenantID = "tenant"
+	SubscriptionID = "sub"
+`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	t.Setenv(azureCredentialsFileEnvVar, path)
+
+	creds, err := credentialsFromFile(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.Equal(t, "client", creds.AADClientID)
+	assert.Equal(t, "sub", creds.SubscriptionID)
+}
+
+func TestCredentialsFromFileJSON(t *testing.T) {
+	clearCredentialEnvVars(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.json")
+	content := `{"Creds":{"ClientID":"client","ClientSecret":"secret","TenantID":"tenant","SubscriptionID":"sub"}}`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	t.Setenv(azureCredentialsFileEnvVar, path)
+
+	creds, err := credentialsFromFile(resolveCloudEnvironment(false))
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.Equal(t, "client", creds.AADClientID)
+	assert.Equal(t, "sub", creds.SubscriptionID)
+}
+
+func TestResolveCloudEnvironment(t *testing.T) {
+	clearCredentialEnvVars(t)
+
+	assert.Equal(t, AzurePublicCloud, resolveCloudEnvironment(false).name)
+	assert.Equal(t, AzureChinaCloud, resolveCloudEnvironment(true).name)
+
+	t.Setenv(azureEnvironmentEnvVar, AzureUSGovernmentCloud)
+	assert.Equal(t, AzureUSGovernmentCloud, resolveCloudEnvironment(false).name)
+	t.Setenv(azureEnvironmentEnvVar, "")
+
+	t.Setenv(azureEnvironmentFilepathEnvVar, "/tmp/does-not-matter.json")
+	assert.Equal(t, AzureStackCloud, resolveCloudEnvironment(false).name)
+}
+
+func TestParseAzureCLIProfile(t *testing.T) {
+	content := []byte(`{"subscriptions":[{"id":"sub-1","tenantId":"tenant-1","isDefault":false},{"id":"sub-2","tenantId":"tenant-2","isDefault":true}]}`)
+
+	profile, err := parseAzureCLIProfile(content)
+	assert.NoError(t, err)
+	assert.NotNil(t, profile)
+	assert.Equal(t, "sub-2", profile.SubscriptionID)
+	assert.Equal(t, "tenant-2", profile.TenantID)
+}
+
+func TestResolveAADClientSecretFromKeyVaultSkipsWhenAlreadySet(t *testing.T) {
+	t.Setenv(aadClientSecretKeyVaultURLEnvVar, "https://example.vault.azure.net")
+	creds := &Credentials{AADClientSecret: "already-set"}
+
+	err := resolveAADClientSecretFromKeyVault(context.Background(), creds)
+	assert.NoError(t, err)
+	assert.Equal(t, "already-set", creds.AADClientSecret)
+}
+
+func TestResolveAADClientSecretFromKeyVaultSkipsWhenURLUnset(t *testing.T) {
+	t.Setenv(aadClientSecretKeyVaultURLEnvVar, "")
+	creds := &Credentials{}
+
+	err := resolveAADClientSecretFromKeyVault(context.Background(), creds)
+	assert.NoError(t, err)
+	assert.Empty(t, creds.AADClientSecret)
+}
+
+func TestParseAzureCLIProfileNoDefault(t *testing.T) {
+	content := []byte(`{"subscriptions":[{"id":"sub-1","tenantId":"tenant-1","isDefault":false}]}`)
+
+	profile, err := parseAzureCLIProfile(content)
+	assert.NoError(t, err)
+	assert.Nil(t, profile)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import "os"
+
+const (
+	AzurePublicCloud       = "AzurePublicCloud"
+	AzureChinaCloud        = "AzureChinaCloud"
+	AzureUSGovernmentCloud = "AzureUSGovernmentCloud"
+	AzureGermanCloud       = "AzureGermanCloud"
+	AzureStackCloud        = "AzureStackCloud"
+
+	// azureEnvironmentFilepathEnvVar points at a JSON environment
+	// definition, as exported by an AzureStack deployment. Its presence
+	// selects AzureStackCloud regardless of any other cloud hint.
+	azureEnvironmentFilepathEnvVar = "AZURE_ENVIRONMENT_FILEPATH"
+
+	// azureEnvironmentEnvVar names one of the clouds in cloudEnvironments
+	// (e.g. AzureUSGovernmentCloud), for sovereign clouds isAzureChinaCloud
+	// can't express. It is checked after AZURE_ENVIRONMENT_FILEPATH and
+	// before isAzureChinaCloud.
+	azureEnvironmentEnvVar = "AZURE_ENVIRONMENT"
+)
+
+// cloudEnvironment carries the defaults needed to fill in an Azure
+// credential file for a given Azure cloud.
+type cloudEnvironment struct {
+	name            string
+	defaultLocation string
+}
+
+// cloudEnvironments is the lookup table of Azure clouds known statically by
+// this package. AzureStack is deliberately excluded: its endpoints are
+// deployment-specific and are instead discovered through
+// AZURE_ENVIRONMENT_FILEPATH.
+var cloudEnvironments = map[string]cloudEnvironment{
+	AzurePublicCloud:       {name: AzurePublicCloud, defaultLocation: "eastus2"},
+	AzureChinaCloud:        {name: AzureChinaCloud, defaultLocation: "chinaeast2"},
+	AzureUSGovernmentCloud: {name: AzureUSGovernmentCloud, defaultLocation: "usgovvirginia"},
+	AzureGermanCloud:       {name: AzureGermanCloud, defaultLocation: "germanycentral"},
+}
+
+// resolveCloudEnvironment picks the cloudEnvironment to use.
+// AZURE_ENVIRONMENT_FILEPATH takes priority, since it marks an AzureStack
+// deployment whose endpoints aren't one of the well-known public clouds.
+// AZURE_ENVIRONMENT can then select any cloud in cloudEnvironments, which
+// isAzureChinaCloud alone can't reach (e.g. AzureUSGovernmentCloud,
+// AzureGermanCloud); isAzureChinaCloud is the final fallback, kept for
+// backward compatibility with existing callers.
+func resolveCloudEnvironment(isAzureChinaCloud bool) cloudEnvironment {
+	if os.Getenv(azureEnvironmentFilepathEnvVar) != "" {
+		return cloudEnvironment{name: AzureStackCloud, defaultLocation: os.Getenv(locationEnvVar)}
+	}
+
+	if name := os.Getenv(azureEnvironmentEnvVar); name != "" {
+		if env, ok := cloudEnvironments[name]; ok {
+			return env
+		}
+	}
+
+	if isAzureChinaCloud {
+		return cloudEnvironments[AzureChinaCloud]
+	}
+
+	return cloudEnvironments[AzurePublicCloud]
+}
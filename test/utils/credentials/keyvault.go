@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+)
+
+const (
+	// aadClientSecretKeyVaultURLEnvVar, when set, makes aadClientSecret be
+	// fetched from Key Vault at runtime when the resolver that produced the
+	// credentials left it empty, so it need not be stored in Prow's TOML.
+	aadClientSecretKeyVaultURLEnvVar = "AAD_CLIENT_SECRET_KEYVAULT_URL"
+	// aadClientSecretKeyVaultSecretNameEnvVar overrides the secret name to
+	// fetch; defaultAADClientSecretKeyVaultSecretName is used otherwise.
+	aadClientSecretKeyVaultSecretNameEnvVar  = "AAD_CLIENT_SECRET_KEYVAULT_SECRET_NAME"
+	defaultAADClientSecretKeyVaultSecretName = "aad-client-secret"
+)
+
+// resolveAADClientSecretFromKeyVault fills in creds.AADClientSecret from Key
+// Vault when AAD_CLIENT_SECRET_KEYVAULT_URL is set and no resolver already
+// supplied one. It authenticates with whatever identity is already
+// available to the process (managed identity, workload identity, or an az
+// login session), so the secret doesn't need to be stored alongside the
+// other Prow credentials.
+func resolveAADClientSecretFromKeyVault(ctx context.Context, creds *Credentials) error {
+	if creds.AADClientSecret != "" {
+		return nil
+	}
+
+	vaultURL := os.Getenv(aadClientSecretKeyVaultURLEnvVar)
+	if vaultURL == "" {
+		return nil
+	}
+
+	secretName := os.Getenv(aadClientSecretKeyVaultSecretNameEnvVar)
+	if secretName == "" {
+		secretName = defaultAADClientSecretKeyVaultSecretName
+	}
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return fmt.Errorf("error creating credential to access %s: %v", vaultURL, err)
+	}
+
+	client, err := azsecrets.NewClient(vaultURL, cred, nil)
+	if err != nil {
+		return fmt.Errorf("error creating key vault client for %s: %v", vaultURL, err)
+	}
+
+	resp, err := client.GetSecret(ctx, secretName, "", nil)
+	if err != nil {
+		return fmt.Errorf("error fetching secret %s from %s: %v", secretName, vaultURL, err)
+	}
+	if resp.Value == nil {
+		return fmt.Errorf("secret %s in %s has no value", secretName, vaultURL)
+	}
+
+	creds.AADClientSecret = *resp.Value
+	return nil
+}
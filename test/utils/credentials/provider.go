@@ -0,0 +1,135 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultCredentialTTL bounds how long a CredentialProvider serves cached
+// credentials before resolving them again, so that a rotated Key Vault
+// secret or Azure CLI login is eventually picked up without an explicit
+// Invalidate.
+const defaultCredentialTTL = 30 * time.Minute
+
+// CredentialProvider resolves and caches Azure credentials for test code.
+// Unlike CreateAzureCredentialFile's predecessor, which wrote a singleton
+// file at TempAzureCredentialFilePath as its only way to hand back
+// credentials, a CredentialProvider can be shared by parallel ginkgo specs
+// without racing on disk, and by callers that only need credentials in
+// memory.
+type CredentialProvider interface {
+	// Get returns cached credentials, resolving them first if the cache is
+	// empty or has exceeded its TTL.
+	Get(ctx context.Context) (*Credentials, error)
+	// WriteToFile resolves credentials via Get and writes them to path in
+	// the JSON format the driver expects.
+	WriteToFile(path string) error
+	// Invalidate drops any cached credentials, forcing the next Get or
+	// WriteToFile to resolve a fresh set.
+	Invalidate()
+}
+
+// providers caches one CredentialProvider per cloud, keyed on
+// isAzureChinaCloud, so callers share a single in-flight resolution instead
+// of each re-reading the environment, Azure CLI cache, or Key Vault.
+var (
+	providersMu sync.Mutex
+	providers   = map[bool]CredentialProvider{}
+)
+
+// GetCredentialProvider returns the shared CredentialProvider for
+// isAzureChinaCloud, creating one with the default TTL on first use.
+func GetCredentialProvider(isAzureChinaCloud bool) CredentialProvider {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if p, ok := providers[isAzureChinaCloud]; ok {
+		return p
+	}
+
+	p := newChainedCredentialProvider(isAzureChinaCloud, defaultCredentialTTL)
+	providers[isAzureChinaCloud] = p
+	return p
+}
+
+// chainedCredentialProvider resolves credentials through the resolver chain
+// in resolveCredentials and caches the result for ttl.
+type chainedCredentialProvider struct {
+	isAzureChinaCloud bool
+	ttl               time.Duration
+
+	mu        sync.Mutex
+	cached    *Credentials
+	expiresAt time.Time
+}
+
+func newChainedCredentialProvider(isAzureChinaCloud bool, ttl time.Duration) *chainedCredentialProvider {
+	return &chainedCredentialProvider{isAzureChinaCloud: isAzureChinaCloud, ttl: ttl}
+}
+
+func (p *chainedCredentialProvider) Get(ctx context.Context) (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached != nil && time.Now().Before(p.expiresAt) {
+		return p.cached, nil
+	}
+
+	creds, err := resolveCredentials(ctx, p.isAzureChinaCloud)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cached = creds
+	p.expiresAt = time.Now().Add(p.ttl)
+	return creds, nil
+}
+
+func (p *chainedCredentialProvider) WriteToFile(path string) error {
+	creds, err := p.Get(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return writeCredentialFile(path, creds)
+}
+
+func (p *chainedCredentialProvider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cached = nil
+	p.expiresAt = time.Time{}
+}
+
+// CreateAzureCredentialFile creates a temporary Azure credential file for
+// Azure File CSI driver tests and returns the credentials. It is a thin,
+// backward-compatible wrapper around the shared CredentialProvider for
+// isAzureChinaCloud; new callers that don't need the file on disk, or that
+// run many specs in parallel, should use GetCredentialProvider directly.
+func CreateAzureCredentialFile(isAzureChinaCloud bool) (*Credentials, error) {
+	provider := GetCredentialProvider(isAzureChinaCloud)
+
+	if err := provider.WriteToFile(TempAzureCredentialFilePath); err != nil {
+		return nil, err
+	}
+
+	return provider.Get(context.Background())
+}
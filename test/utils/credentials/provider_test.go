@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package credentials
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainedCredentialProviderCachesUntilTTLExpires(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(tenantIDEnvVar, "tenant")
+	t.Setenv(subscriptionIDEnvVar, "sub")
+	t.Setenv(aadClientIDEnvVar, "client")
+	t.Setenv(aadClientSecretEnvVar, "secret")
+
+	p := newChainedCredentialProvider(false, time.Hour)
+
+	first, err := p.Get(context.Background())
+	assert.NoError(t, err)
+	assert.NotNil(t, first)
+
+	// Changing the underlying env shouldn't be observed until the cache
+	// is invalidated or its TTL elapses.
+	t.Setenv(aadClientSecretEnvVar, "rotated-secret")
+	second, err := p.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, "secret", second.AADClientSecret)
+}
+
+func TestChainedCredentialProviderInvalidate(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(tenantIDEnvVar, "tenant")
+	t.Setenv(subscriptionIDEnvVar, "sub")
+	t.Setenv(aadClientIDEnvVar, "client")
+	t.Setenv(aadClientSecretEnvVar, "secret")
+
+	p := newChainedCredentialProvider(false, time.Hour)
+
+	first, err := p.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", first.AADClientSecret)
+
+	t.Setenv(aadClientSecretEnvVar, "rotated-secret")
+	p.Invalidate()
+
+	second, err := p.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated-secret", second.AADClientSecret)
+}
+
+func TestChainedCredentialProviderExpiresAfterTTL(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(tenantIDEnvVar, "tenant")
+	t.Setenv(subscriptionIDEnvVar, "sub")
+	t.Setenv(aadClientIDEnvVar, "client")
+	t.Setenv(aadClientSecretEnvVar, "secret")
+
+	p := newChainedCredentialProvider(false, time.Millisecond)
+
+	_, err := p.Get(context.Background())
+	assert.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	t.Setenv(aadClientSecretEnvVar, "rotated-secret")
+
+	second, err := p.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated-secret", second.AADClientSecret)
+}
+
+func TestGetCredentialProviderIsSharedPerCloud(t *testing.T) {
+	assert.Same(t, GetCredentialProvider(false), GetCredentialProvider(false))
+	assert.NotSame(t, GetCredentialProvider(false), GetCredentialProvider(true))
+}
+
+func TestChainedCredentialProviderConcurrentGet(t *testing.T) {
+	clearCredentialEnvVars(t)
+	t.Setenv(tenantIDEnvVar, "tenant")
+	t.Setenv(subscriptionIDEnvVar, "sub")
+	t.Setenv(aadClientIDEnvVar, "client")
+	t.Setenv(aadClientSecretEnvVar, "secret")
+
+	p := newChainedCredentialProvider(false, time.Hour)
+
+	var errCount int32
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			if _, err := p.Get(context.Background()); err != nil {
+				atomic.AddInt32(&errCount, 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	assert.Zero(t, errCount)
+}